@@ -3,12 +3,16 @@ package storage
 import (
 	"context"
 	"fmt"
+	"sync"
+	"time"
 
 	"github.com/distribution/distribution/v3"
 	"github.com/distribution/distribution/v3/manifest/manifestlist"
+	"github.com/distribution/distribution/v3/manifest/ocischema"
 	"github.com/distribution/distribution/v3/reference"
 	"github.com/distribution/distribution/v3/registry/storage/driver"
 	"github.com/opencontainers/go-digest"
+	"golang.org/x/sync/errgroup"
 )
 
 func emit(format string, a ...interface{}) {
@@ -19,6 +23,56 @@ func emit(format string, a ...interface{}) {
 type GCOpts struct {
 	DryRun         bool
 	RemoveUntagged bool
+
+	// Parallelism controls how many repositories are marked concurrently
+	// during the mark phase, and how many blobs are deleted concurrently
+	// during the sweep phase. Values <= 1 preserve the original strictly
+	// sequential behavior.
+	Parallelism int
+
+	// GracePeriod is the minimum amount of time that must have passed
+	// since a blob was last modified before it is eligible for deletion.
+	// This protects blobs belonging to an upload that is in flight: the
+	// client may have pushed the blob but not yet linked it from a
+	// manifest. A zero value disables the grace period.
+	GracePeriod time.Duration
+
+	// ManifestGracePeriod is the same protection as GracePeriod, applied
+	// to untagged manifests instead of blobs. A zero value disables the
+	// grace period.
+	ManifestGracePeriod time.Duration
+
+	// PreserveReferrers, when set, keeps an OCI 1.1 artifact manifest
+	// (e.g. a cosign signature or SBOM) reachable as long as the
+	// manifest it refers to via its `subject` field is reachable, even
+	// though the artifact manifest itself carries no tag. Reachability
+	// is resolved transitively, so a referrer of a referrer (a
+	// signature on a signature) is also preserved.
+	PreserveReferrers bool
+
+	// Reporter receives structured progress events as MarkAndSweep runs.
+	// If nil, a StdoutReporter is used, preserving the CLI's original
+	// plain-text output.
+	Reporter GCReporter
+
+	// Checkpoint, when set, enables resumable GC: mark and sweep
+	// progress is periodically flushed to this driver so a crashed run
+	// can pick up where it left off instead of restarting from scratch.
+	Checkpoint driver.StorageDriver
+
+	// RunID identifies this GC run for checkpointing purposes. It must
+	// be set whenever Checkpoint is set.
+	RunID string
+
+	// ResumeRunID, when set, seeds the mark set, completed-repository
+	// cursor, and already-deleted blob set from a previous run's
+	// checkpoint before this run begins.
+	ResumeRunID string
+
+	// CheckpointInterval controls how often mark and sweep progress is
+	// flushed to Checkpoint. A zero value checkpoints after every
+	// repository (mark phase) or blob (sweep phase).
+	CheckpointInterval time.Duration
 }
 
 // ManifestDel contains manifest structure which will be deleted
@@ -28,168 +82,442 @@ type ManifestDel struct {
 	Tags   []string
 }
 
+// markResult holds the output of marking a single repository so it can be
+// merged into the shared mark set and manifest deletion list.
+type markResult struct {
+	markSet     map[digest.Digest]struct{}
+	manifestArr []ManifestDel
+}
+
 // MarkAndSweep performs a mark and sweep of registry data
-func MarkAndSweep(ctx context.Context, storageDriver driver.StorageDriver, registry distribution.Namespace, opts GCOpts) error {
+func MarkAndSweep(ctx context.Context, storageDriver driver.StorageDriver, registry distribution.Namespace, opts GCOpts) (err error) {
 	repositoryEnumerator, ok := registry.(distribution.RepositoryEnumerator)
 	if !ok {
 		return fmt.Errorf("unable to convert Namespace to RepositoryEnumerator")
 	}
 
+	parallelism := opts.Parallelism
+	if parallelism < 1 {
+		parallelism = 1
+	}
+
+	reporter := opts.Reporter
+	if reporter == nil {
+		reporter = NewStdoutReporter()
+	}
+	defer func() {
+		reporter.Err(err)
+	}()
+
 	// mark
+	var mu sync.Mutex
 	markSet := make(map[digest.Digest]struct{})
 	manifestArr := make([]ManifestDel, 0)
-	err := repositoryEnumerator.Enumerate(ctx, func(repoName string) error {
-		emit(repoName)
+	completedRepos := make(map[string]struct{})
+
+	// markBatchSeq numbers the batches this run flushes. Batch files
+	// are addressed by RunID and sequence number alone, so a resumed
+	// run must continue numbering from where the run it's resuming
+	// left off, not restart at 0 and overwrite that run's batches.
+	markBatchSeq := 0
 
-		var err error
-		named, err := reference.WithName(repoName)
+	if opts.Checkpoint != nil && opts.ResumeRunID != "" {
+		markCheckpoint, err := loadGCMarkCheckpoint(ctx, opts.Checkpoint, opts.ResumeRunID)
 		if err != nil {
-			return fmt.Errorf("failed to parse repo name %s: %v", repoName, err)
+			return fmt.Errorf("failed to load mark checkpoint: %v", err)
 		}
-		repository, err := registry.Repository(ctx, named)
-		if err != nil {
-			return fmt.Errorf("failed to construct repository: %v", err)
+		for _, dgst := range markCheckpoint.MarkSet {
+			markSet[dgst] = struct{}{}
 		}
-
-		manifestService, err := repository.Manifests(ctx)
-		if err != nil {
-			return fmt.Errorf("failed to construct manifest service: %v", err)
+		manifestArr = append(manifestArr, markCheckpoint.ManifestArr...)
+		for _, repoName := range markCheckpoint.CompletedRepositories {
+			completedRepos[repoName] = struct{}{}
 		}
+		markBatchSeq = markCheckpoint.BatchCount
+	}
 
-		manifestEnumerator, ok := manifestService.(distribution.ManifestEnumerator)
-		if !ok {
-			return fmt.Errorf("unable to convert ManifestService into ManifestEnumerator")
-		}
+	// markSetDelta, manifestArrDelta and completedReposDelta track mark
+	// phase progress made since the last checkpoint flush. Flushing
+	// only this delta, instead of the whole accumulated markSet and
+	// manifestArr, keeps checkpoint-write cost proportional to one
+	// checkpoint interval rather than to the size of the run so far.
+	markSetDelta := make(map[digest.Digest]struct{})
+	manifestArrDelta := make([]ManifestDel, 0)
+	completedReposDelta := make([]string, 0)
 
-		manifests := make(map[digest.Digest]digest.Digest)
-		untaggedManifists := make(map[digest.Digest]struct{})
-		err = manifestEnumerator.Enumerate(ctx, func(dgst digest.Digest) error {
-			// make manifestlist map
-			references := make([]digest.Digest, 0)
-			manifest, err := manifestService.Get(ctx, dgst)
-			if err != nil {
-				return fmt.Errorf("failed to retrieve manifest for digest %v: %v", dgst, err)
-			}
-			if mfl, ok := manifest.(*manifestlist.DeserializedManifestList); ok {
-				for _, mf := range mfl.ManifestList.Manifests {
-					manifests[mf.Digest] = dgst
-					references = append(references, mf.Digest)
-				}
-			}
-			if _, exist := manifests[dgst]; !exist {
-				manifests[dgst] = dgst
-			}
-			if _, exist := untaggedManifists[dgst]; !exist {
-				references = append(references, dgst)
-			}
+	lastMarkFlush := time.Now()
+	eg, egCtx := errgroup.WithContext(ctx)
+	sem := make(chan struct{}, parallelism)
 
-			if opts.RemoveUntagged {
-				for _, ref := range references {
-					// fetch all tags where this manifest is the latest one
-					tags, err := repository.Tags(ctx).Lookup(ctx, distribution.Descriptor{Digest: ref})
-					if err != nil {
-						return fmt.Errorf("failed to retrieve tags for digest %v: %v", ref, err)
-					}
-					if len(tags) == 0 {
-						untaggedManifists[ref] = struct{}{}
-					}
-				}
-			}
+	err = repositoryEnumerator.Enumerate(ctx, func(repoName string) error {
+		mu.Lock()
+		_, done := completedRepos[repoName]
+		mu.Unlock()
+		if done {
 			return nil
-		})
+		}
 
-		for dgst, mfl := range manifests {
-			_, manifestUntaged := untaggedManifists[dgst]
-			_, manifestListUntaged := untaggedManifists[mfl]
-			if manifestUntaged && manifestListUntaged {
-				emit("manifest eligible for deletion: %s", dgst)
-				manifestArr = append(manifestArr, ManifestDel{Name: repoName, Digest: dgst, Tags: nil})
-				continue
-			}
+		select {
+		case sem <- struct{}{}:
+		case <-egCtx.Done():
+			return egCtx.Err()
+		}
 
-			// Mark the manifest's blob
-			emit("%s: marking manifest %s ", repoName, dgst)
-			markSet[dgst] = struct{}{}
+		eg.Go(func() error {
+			defer func() { <-sem }()
 
-			manifest, err := manifestService.Get(ctx, dgst)
+			result, err := markRepository(egCtx, storageDriver, registry, repoName, opts, reporter)
 			if err != nil {
-				if _, ok := err.(distribution.ErrManifestUnknownRevision); ok {
-					continue
-				}
-				return fmt.Errorf("mark failed to retrieve manifest for digest %v: %v", dgst, err)
+				return err
 			}
 
-			descriptors := manifest.References()
-			for _, descriptor := range descriptors {
-				markSet[descriptor.Digest] = struct{}{}
-				emit("%s: marking blob %s", repoName, descriptor.Digest)
-			}
-		}
-
-		if !opts.DryRun && len(manifestArr) > 0 {
-			// fetch all tags from repository
-			// all of these tags could contain manifest in history
-			// which means that we need check (and delete) those references when deleting manifest
-			allTags, err := repository.Tags(ctx).All(ctx)
-			if err != nil {
-				if _, ok := err.(distribution.ErrRepositoryUnknown); !ok {
-					return fmt.Errorf("failed to retrieve tags %v", err)
+			mu.Lock()
+			defer mu.Unlock()
+			for dgst := range result.markSet {
+				if _, ok := markSet[dgst]; !ok {
+					markSetDelta[dgst] = struct{}{}
 				}
+				markSet[dgst] = struct{}{}
 			}
+			manifestArr = append(manifestArr, result.manifestArr...)
+			manifestArrDelta = append(manifestArrDelta, result.manifestArr...)
 
-			for _, m := range manifestArr {
-				m.Tags = allTags
+			if opts.Checkpoint != nil {
+				completedRepos[repoName] = struct{}{}
+				completedReposDelta = append(completedReposDelta, repoName)
+				if time.Since(lastMarkFlush) >= opts.CheckpointInterval {
+					if err := flushGCMarkBatch(egCtx, opts, markBatchSeq, completedReposDelta, markSetDelta, manifestArrDelta); err != nil {
+						return err
+					}
+					markBatchSeq++
+					completedReposDelta = nil
+					markSetDelta = make(map[digest.Digest]struct{})
+					manifestArrDelta = nil
+					lastMarkFlush = time.Now()
+				}
 			}
-		}
-
-		// In certain situations such as unfinished uploads, deleting all
-		// tags in S3 or removing the _manifests folder manually, this
-		// error may be of type PathNotFound.
-		//
-		// In these cases we can continue marking other manifests safely.
-		if _, ok := err.(driver.PathNotFoundError); ok {
 			return nil
-		}
-
-		return err
+		})
+		return nil
 	})
 	if err != nil {
 		return fmt.Errorf("failed to mark: %v", err)
 	}
+	if err := eg.Wait(); err != nil {
+		return fmt.Errorf("failed to mark: %v", err)
+	}
+
+	if opts.Checkpoint != nil && (len(completedReposDelta) > 0 || len(markSetDelta) > 0 || len(manifestArrDelta) > 0) {
+		if err := flushGCMarkBatch(ctx, opts, markBatchSeq, completedReposDelta, markSetDelta, manifestArrDelta); err != nil {
+			return fmt.Errorf("failed to flush mark checkpoint: %v", err)
+		}
+	}
 
 	// sweep
 	vacuum := NewVacuum(ctx, storageDriver)
 	if !opts.DryRun {
 		for _, obj := range manifestArr {
-			err = vacuum.RemoveManifest(obj.Name, obj.Digest, obj.Tags)
-			if err != nil {
+			if err := vacuum.RemoveManifest(obj.Name, obj.Digest, obj.Tags); err != nil {
 				return fmt.Errorf("failed to delete manifest %s: %v", obj.Digest, err)
 			}
 		}
 	}
+	sweptBlobs := make(map[digest.Digest]struct{})
+	if opts.Checkpoint != nil && opts.ResumeRunID != "" {
+		sweepCheckpoint, err := loadGCSweepCheckpoint(ctx, opts.Checkpoint, opts.ResumeRunID)
+		if err != nil {
+			return fmt.Errorf("failed to load sweep checkpoint: %v", err)
+		}
+		for _, dgst := range sweepCheckpoint.DeletedBlobs {
+			sweptBlobs[dgst] = struct{}{}
+		}
+	}
+
 	blobService := registry.Blobs()
 	deleteSet := make(map[digest.Digest]struct{})
 	err = blobService.Enumerate(ctx, func(dgst digest.Digest) error {
 		// check if digest is in markSet. If not, delete it!
-		if _, ok := markSet[dgst]; !ok {
-			deleteSet[dgst] = struct{}{}
+		if _, ok := markSet[dgst]; ok {
+			return nil
 		}
+		if _, ok := sweptBlobs[dgst]; ok {
+			// already deleted by a prior, interrupted run
+			return nil
+		}
+
+		old, err := isOlderThanGracePeriod(ctx, storageDriver, blobDataPathSpec{digest: dgst}, opts.GracePeriod)
+		if err != nil {
+			return fmt.Errorf("failed to stat blob %s: %v", dgst, err)
+		}
+		if !old {
+			return nil
+		}
+
+		deleteSet[dgst] = struct{}{}
 		return nil
 	})
 	if err != nil {
 		return fmt.Errorf("error enumerating blobs: %v", err)
 	}
-	emit("\n%d blobs marked, %d blobs and %d manifests eligible for deletion", len(markSet), len(deleteSet), len(manifestArr))
+	reporter.Summary(len(markSet), len(deleteSet), len(manifestArr))
+	if opts.DryRun {
+		for dgst := range deleteSet {
+			reporter.BlobEligibleForDeletion(dgst)
+		}
+		return nil
+	}
+
+	var sweepMu sync.Mutex
+	lastSweepFlush := time.Now()
+	deleteEg, deleteCtx := errgroup.WithContext(ctx)
+	deleteSem := make(chan struct{}, parallelism)
+deleteLoop:
 	for dgst := range deleteSet {
-		emit("blob eligible for deletion: %s", dgst)
-		if opts.DryRun {
+		dgst := dgst
+		select {
+		case deleteSem <- struct{}{}:
+		case <-deleteCtx.Done():
+			break deleteLoop
+		}
+
+		deleteEg.Go(func() error {
+			defer func() { <-deleteSem }()
+			reporter.BlobEligibleForDeletion(dgst)
+			if err := vacuum.RemoveBlob(string(dgst)); err != nil {
+				return fmt.Errorf("failed to delete blob %s: %v", dgst, err)
+			}
+
+			if opts.Checkpoint != nil {
+				sweepMu.Lock()
+				defer sweepMu.Unlock()
+				sweptBlobs[dgst] = struct{}{}
+				if time.Since(lastSweepFlush) >= opts.CheckpointInterval {
+					if err := flushGCSweepCheckpoint(deleteCtx, opts, sweptBlobs); err != nil {
+						return err
+					}
+					lastSweepFlush = time.Now()
+				}
+			}
+			return nil
+		})
+	}
+
+	if err := deleteEg.Wait(); err != nil {
+		return err
+	}
+
+	if opts.Checkpoint != nil {
+		if err := flushGCSweepCheckpoint(ctx, opts, sweptBlobs); err != nil {
+			return fmt.Errorf("failed to flush sweep checkpoint: %v", err)
+		}
+		deleteGCCheckpoints(ctx, opts.Checkpoint, opts.RunID)
+	}
+
+	return nil
+}
+
+// markRepository enumerates the manifests of a single repository and
+// returns the set of blob digests they reference, along with any
+// manifests that are eligible for deletion. It is safe to call
+// concurrently for distinct repositories.
+func markRepository(ctx context.Context, storageDriver driver.StorageDriver, registry distribution.Namespace, repoName string, opts GCOpts, reporter GCReporter) (markResult, error) {
+	reporter.RepositoryStarted(repoName)
+
+	markSet := make(map[digest.Digest]struct{})
+	manifestArr := make([]ManifestDel, 0)
+
+	named, err := reference.WithName(repoName)
+	if err != nil {
+		return markResult{}, fmt.Errorf("failed to parse repo name %s: %v", repoName, err)
+	}
+	repository, err := registry.Repository(ctx, named)
+	if err != nil {
+		return markResult{}, fmt.Errorf("failed to construct repository: %v", err)
+	}
+
+	manifestService, err := repository.Manifests(ctx)
+	if err != nil {
+		return markResult{}, fmt.Errorf("failed to construct manifest service: %v", err)
+	}
+
+	manifestEnumerator, ok := manifestService.(distribution.ManifestEnumerator)
+	if !ok {
+		return markResult{}, fmt.Errorf("unable to convert ManifestService into ManifestEnumerator")
+	}
+
+	manifests := make(map[digest.Digest]digest.Digest)
+	untaggedManifists := make(map[digest.Digest]struct{})
+	subjectOf := make(map[digest.Digest]digest.Digest)
+	err = manifestEnumerator.Enumerate(ctx, func(dgst digest.Digest) error {
+		// make manifestlist map
+		references := make([]digest.Digest, 0)
+		manifest, err := manifestService.Get(ctx, dgst)
+		if err != nil {
+			return fmt.Errorf("failed to retrieve manifest for digest %v: %v", dgst, err)
+		}
+		if mfl, ok := manifest.(*manifestlist.DeserializedManifestList); ok {
+			for _, mf := range mfl.ManifestList.Manifests {
+				manifests[mf.Digest] = dgst
+				references = append(references, mf.Digest)
+			}
+		}
+		if opts.PreserveReferrers {
+			if om, ok := manifest.(*ocischema.DeserializedManifest); ok && om.Subject != nil {
+				subjectOf[dgst] = om.Subject.Digest
+			}
+		}
+		if _, exist := manifests[dgst]; !exist {
+			manifests[dgst] = dgst
+		}
+		if _, exist := untaggedManifists[dgst]; !exist {
+			references = append(references, dgst)
+		}
+
+		if opts.RemoveUntagged {
+			for _, ref := range references {
+				// fetch all tags where this manifest is the latest one
+				tags, err := repository.Tags(ctx).Lookup(ctx, distribution.Descriptor{Digest: ref})
+				if err != nil {
+					return fmt.Errorf("failed to retrieve tags for digest %v: %v", ref, err)
+				}
+				if len(tags) == 0 {
+					untaggedManifists[ref] = struct{}{}
+				}
+			}
+		}
+		return nil
+	})
+
+	// reachable holds the manifests that are not candidates for deletion,
+	// either because they (or their manifest list) carry a tag, or
+	// because they were pulled in transitively as a referrer of a
+	// reachable manifest below.
+	reachable := make(map[digest.Digest]struct{})
+	for dgst, mfl := range manifests {
+		_, manifestUntaged := untaggedManifists[dgst]
+		_, manifestListUntaged := untaggedManifists[mfl]
+		if !(manifestUntaged && manifestListUntaged) {
+			reachable[dgst] = struct{}{}
+		}
+	}
+
+	if opts.PreserveReferrers {
+		// Fixed point over the subject graph: a referrer becomes
+		// reachable once its subject is reachable, which may in turn
+		// make a referrer-of-that-referrer reachable.
+		for changed := true; changed; {
+			changed = false
+			for dgst, subject := range subjectOf {
+				if _, ok := reachable[dgst]; ok {
+					continue
+				}
+				if _, ok := reachable[subject]; ok {
+					reachable[dgst] = struct{}{}
+					changed = true
+				}
+			}
+		}
+	}
+
+	// markReferencedBlobs fetches the manifest at dgst and marks every
+	// blob it references, so a manifest kept around either because it's
+	// reachable or because it's still within its grace period never
+	// ends up with its layers/config swept out from under it.
+	markReferencedBlobs := func(dgst digest.Digest) error {
+		manifest, err := manifestService.Get(ctx, dgst)
+		if err != nil {
+			if _, ok := err.(distribution.ErrManifestUnknownRevision); ok {
+				return nil
+			}
+			return fmt.Errorf("mark failed to retrieve manifest for digest %v: %v", dgst, err)
+		}
+
+		for _, descriptor := range manifest.References() {
+			markSet[descriptor.Digest] = struct{}{}
+			reporter.BlobMarked(repoName, descriptor.Digest)
+		}
+		return nil
+	}
+
+	for dgst := range manifests {
+		if _, ok := reachable[dgst]; !ok {
+			old, err := isOlderThanGracePeriod(ctx, storageDriver, manifestRevisionLinkPathSpec{name: repoName, revision: dgst}, opts.ManifestGracePeriod)
+			if err != nil {
+				return markResult{}, fmt.Errorf("failed to stat manifest %s: %v", dgst, err)
+			}
+			if !old {
+				// still within the grace period: treat it as reachable
+				// for this run so a concurrent push isn't raced.
+				markSet[dgst] = struct{}{}
+				if err := markReferencedBlobs(dgst); err != nil {
+					return markResult{}, err
+				}
+				continue
+			}
+
+			reporter.ManifestEligibleForDeletion(repoName, dgst)
+			manifestArr = append(manifestArr, ManifestDel{Name: repoName, Digest: dgst, Tags: nil})
 			continue
 		}
-		err = vacuum.RemoveBlob(string(dgst))
+
+		// Mark the manifest's blob
+		reporter.ManifestMarked(repoName, dgst)
+		markSet[dgst] = struct{}{}
+		if err := markReferencedBlobs(dgst); err != nil {
+			return markResult{}, err
+		}
+	}
+
+	if !opts.DryRun && len(manifestArr) > 0 {
+		// fetch all tags from repository
+		// all of these tags could contain manifest in history
+		// which means that we need check (and delete) those references when deleting manifest
+		allTags, err := repository.Tags(ctx).All(ctx)
 		if err != nil {
-			return fmt.Errorf("failed to delete blob %s: %v", dgst, err)
+			if _, ok := err.(distribution.ErrRepositoryUnknown); !ok {
+				return markResult{}, fmt.Errorf("failed to retrieve tags %v", err)
+			}
+		}
+
+		for i := range manifestArr {
+			manifestArr[i].Tags = allTags
+		}
+	}
+
+	// In certain situations such as unfinished uploads, deleting all
+	// tags in S3 or removing the _manifests folder manually, this
+	// error may be of type PathNotFound.
+	//
+	// In these cases we can continue marking other manifests safely.
+	if _, ok := err.(driver.PathNotFoundError); ok {
+		return markResult{markSet: markSet, manifestArr: manifestArr}, nil
+	}
+
+	return markResult{markSet: markSet, manifestArr: manifestArr}, err
+}
+
+// isOlderThanGracePeriod reports whether the object addressed by pathSpec
+// was last modified before gracePeriod ago. A gracePeriod <= 0 disables
+// the check and always reports true. A missing object is treated as
+// older than the grace period so that deletion candidates which have
+// already disappeared don't block GC.
+func isOlderThanGracePeriod(ctx context.Context, storageDriver driver.StorageDriver, pathSpec PathSpec, gracePeriod time.Duration) (bool, error) {
+	if gracePeriod <= 0 {
+		return true, nil
+	}
+
+	path, err := pathFor(pathSpec)
+	if err != nil {
+		return false, err
+	}
+
+	fi, err := storageDriver.Stat(ctx, path)
+	if err != nil {
+		if _, ok := err.(driver.PathNotFoundError); ok {
+			return true, nil
 		}
+		return false, err
 	}
 
-	return err
+	return fi.ModTime().Before(time.Now().Add(-gracePeriod)), nil
 }
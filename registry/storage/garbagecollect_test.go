@@ -0,0 +1,440 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/distribution/distribution/v3"
+	"github.com/distribution/distribution/v3/manifest/ocischema"
+	"github.com/distribution/distribution/v3/manifest/schema2"
+	"github.com/distribution/distribution/v3/reference"
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/opencontainers/go-digest"
+)
+
+// gcTestFixture bundles the registry and driver a garbage collection
+// test runs against.
+type gcTestFixture struct {
+	driver   *inmemory.Driver
+	registry distribution.Namespace
+}
+
+func newGCTestFixture(t *testing.T) *gcTestFixture {
+	t.Helper()
+	d := inmemory.New()
+	registry, err := NewRegistry(context.Background(), d, EnableDelete, EnableSchema1)
+	if err != nil {
+		t.Fatalf("failed to construct registry: %v", err)
+	}
+	return &gcTestFixture{driver: d, registry: registry}
+}
+
+// pushedManifest records the digests produced by pushManifest so tests
+// can assert on their survival after a GC run without having to
+// recompute them.
+type pushedManifest struct {
+	manifestDigest digest.Digest
+	config         distribution.Descriptor
+	layer          distribution.Descriptor
+}
+
+// pushBlob uploads content to repository's blob store and returns its
+// descriptor.
+func pushBlob(t *testing.T, ctx context.Context, repository distribution.Repository, content []byte) distribution.Descriptor {
+	t.Helper()
+	bw, err := repository.Blobs(ctx).Create(ctx)
+	if err != nil {
+		t.Fatalf("failed to create blob writer: %v", err)
+	}
+	if _, err := bw.Write(content); err != nil {
+		t.Fatalf("failed to write blob: %v", err)
+	}
+	desc, err := bw.Commit(ctx, distribution.Descriptor{Digest: digest.FromBytes(content), Size: int64(len(content))})
+	if err != nil {
+		t.Fatalf("failed to commit blob: %v", err)
+	}
+	return desc
+}
+
+// pushManifest builds and stores a schema2 manifest referencing a
+// single config and layer blob in repository, optionally tagging it,
+// and returns the digests involved. Blob content is derived from tag
+// and the repository name, so the same arguments yield the same digests.
+func pushManifest(t *testing.T, ctx context.Context, repository distribution.Repository, tag string) pushedManifest {
+	t.Helper()
+	config := pushBlob(t, ctx, repository, []byte(fmt.Sprintf(`{"config":%q}`, tag+repository.Named().Name())))
+	layer := pushBlob(t, ctx, repository, []byte("layer content: "+tag+repository.Named().Name()))
+
+	manifest, err := schema2.FromStruct(schema2.Manifest{
+		Versioned: schema2.SchemaVersion,
+		Config:    config,
+		Layers:    []distribution.Descriptor{layer},
+	})
+	if err != nil {
+		t.Fatalf("failed to build manifest: %v", err)
+	}
+
+	manifestService, err := repository.Manifests(ctx)
+	if err != nil {
+		t.Fatalf("failed to construct manifest service: %v", err)
+	}
+	dgst, err := manifestService.Put(ctx, manifest)
+	if err != nil {
+		t.Fatalf("failed to put manifest: %v", err)
+	}
+
+	if tag != "" {
+		if err := repository.Tags(ctx).Tag(ctx, tag, distribution.Descriptor{Digest: dgst}); err != nil {
+			t.Fatalf("failed to tag manifest: %v", err)
+		}
+	}
+
+	return pushedManifest{manifestDigest: dgst, config: config, layer: layer}
+}
+
+// blobExists reports whether a blob's data file is still present on
+// disk, i.e. whether it survived (or was swept by) a GC run.
+func blobExists(t *testing.T, ctx context.Context, d *inmemory.Driver, dgst digest.Digest) bool {
+	t.Helper()
+	path, err := pathFor(blobDataPathSpec{digest: dgst})
+	if err != nil {
+		t.Fatalf("failed to compute blob path: %v", err)
+	}
+	if _, err := d.Stat(ctx, path); err != nil {
+		return false
+	}
+	return true
+}
+
+// TestMarkAndSweepParallelismEquivalence checks that running the mark
+// phase with a bounded worker pool (Parallelism > 1) sweeps exactly the
+// same blobs as the strictly serial path (Parallelism <= 1).
+func TestMarkAndSweepParallelismEquivalence(t *testing.T) {
+	ctx := context.Background()
+
+	run := func(t *testing.T, parallelism int) {
+		fixture := newGCTestFixture(t)
+		var kept, deleted []pushedManifest
+		for i := 0; i < 8; i++ {
+			named, err := reference.WithName(fmt.Sprintf("repo-%d", i))
+			if err != nil {
+				t.Fatalf("failed to parse repo name: %v", err)
+			}
+			repository, err := fixture.registry.Repository(ctx, named)
+			if err != nil {
+				t.Fatalf("failed to construct repository: %v", err)
+			}
+			if i%2 == 0 {
+				kept = append(kept, pushManifest(t, ctx, repository, "latest"))
+			} else {
+				deleted = append(deleted, pushManifest(t, ctx, repository, ""))
+			}
+		}
+
+		if err := MarkAndSweep(ctx, fixture.driver, fixture.registry, GCOpts{
+			RemoveUntagged: true,
+			Parallelism:    parallelism,
+		}); err != nil {
+			t.Fatalf("MarkAndSweep failed: %v", err)
+		}
+
+		for _, pm := range kept {
+			if !blobExists(t, ctx, fixture.driver, pm.layer.Digest) {
+				t.Errorf("parallelism=%d: expected tagged manifest's layer %s to survive", parallelism, pm.layer.Digest)
+			}
+		}
+		for _, pm := range deleted {
+			if blobExists(t, ctx, fixture.driver, pm.layer.Digest) {
+				t.Errorf("parallelism=%d: expected untagged manifest's layer %s to be swept", parallelism, pm.layer.Digest)
+			}
+		}
+	}
+
+	t.Run("serial", func(t *testing.T) { run(t, 1) })
+	t.Run("parallel", func(t *testing.T) { run(t, 8) })
+}
+
+// TestMarkAndSweepManifestGracePeriod checks that an untagged manifest
+// still inside its grace period keeps its referenced blobs reachable,
+// not just its own digest, so a manifest in the grace period never
+// loses its layers/config to the same run that's protecting it.
+func TestMarkAndSweepManifestGracePeriod(t *testing.T) {
+	ctx := context.Background()
+	fixture := newGCTestFixture(t)
+
+	named, err := reference.WithName("repo")
+	if err != nil {
+		t.Fatalf("failed to parse repo name: %v", err)
+	}
+	repository, err := fixture.registry.Repository(ctx, named)
+	if err != nil {
+		t.Fatalf("failed to construct repository: %v", err)
+	}
+
+	pm := pushManifest(t, ctx, repository, "")
+
+	if err := MarkAndSweep(ctx, fixture.driver, fixture.registry, GCOpts{
+		RemoveUntagged:      true,
+		ManifestGracePeriod: time.Hour,
+	}); err != nil {
+		t.Fatalf("MarkAndSweep failed: %v", err)
+	}
+
+	if !blobExists(t, ctx, fixture.driver, pm.layer.Digest) {
+		t.Error("expected layer blob of a manifest still within its grace period to survive")
+	}
+	if !blobExists(t, ctx, fixture.driver, pm.config.Digest) {
+		t.Error("expected config blob of a manifest still within its grace period to survive")
+	}
+}
+
+// TestMarkAndSweepBlobGracePeriod checks that GCOpts.GracePeriod
+// protects an orphaned blob that isn't referenced by any manifest at
+// all: a blob pushed just ahead of this run, before the client that
+// pushed it has had a chance to link it from a manifest, must survive
+// as long as it's still within the grace period.
+func TestMarkAndSweepBlobGracePeriod(t *testing.T) {
+	ctx := context.Background()
+	fixture := newGCTestFixture(t)
+
+	named, err := reference.WithName("repo")
+	if err != nil {
+		t.Fatalf("failed to parse repo name: %v", err)
+	}
+	repository, err := fixture.registry.Repository(ctx, named)
+	if err != nil {
+		t.Fatalf("failed to construct repository: %v", err)
+	}
+
+	orphan := pushBlob(t, ctx, repository, []byte("orphaned blob, upload still in flight"))
+
+	if err := MarkAndSweep(ctx, fixture.driver, fixture.registry, GCOpts{
+		GracePeriod: time.Hour,
+	}); err != nil {
+		t.Fatalf("MarkAndSweep failed: %v", err)
+	}
+
+	if !blobExists(t, ctx, fixture.driver, orphan.Digest) {
+		t.Error("expected an orphaned blob still within its grace period to survive")
+	}
+}
+
+// TestMarkAndSweepPreservesReferrers checks that an OCI 1.1 referrer
+// (e.g. a cosign signature or SBOM) survives as long as the manifest
+// named in its subject field is reachable, even though the referrer
+// itself carries no tag.
+func TestMarkAndSweepPreservesReferrers(t *testing.T) {
+	ctx := context.Background()
+	fixture := newGCTestFixture(t)
+
+	named, err := reference.WithName("repo")
+	if err != nil {
+		t.Fatalf("failed to parse repo name: %v", err)
+	}
+	repository, err := fixture.registry.Repository(ctx, named)
+	if err != nil {
+		t.Fatalf("failed to construct repository: %v", err)
+	}
+
+	subject := pushManifest(t, ctx, repository, "latest")
+
+	signatureConfig := pushBlob(t, ctx, repository, []byte(`{"config":true}`))
+	signatureLayer := pushBlob(t, ctx, repository, []byte("signature content"))
+	signatureManifest, err := ocischema.FromStruct(ocischema.Manifest{
+		Versioned: ocischema.SchemaVersion,
+		Config:    signatureConfig,
+		Layers:    []distribution.Descriptor{signatureLayer},
+		Subject:   &distribution.Descriptor{Digest: subject.manifestDigest},
+	})
+	if err != nil {
+		t.Fatalf("failed to build referrer manifest: %v", err)
+	}
+
+	manifestService, err := repository.Manifests(ctx)
+	if err != nil {
+		t.Fatalf("failed to construct manifest service: %v", err)
+	}
+	referrerDigest, err := manifestService.Put(ctx, signatureManifest)
+	if err != nil {
+		t.Fatalf("failed to put referrer manifest: %v", err)
+	}
+
+	if err := MarkAndSweep(ctx, fixture.driver, fixture.registry, GCOpts{
+		RemoveUntagged:    true,
+		PreserveReferrers: true,
+	}); err != nil {
+		t.Fatalf("MarkAndSweep failed: %v", err)
+	}
+
+	manifestPath, err := pathFor(manifestRevisionLinkPathSpec{name: "repo", revision: referrerDigest})
+	if err != nil {
+		t.Fatalf("failed to compute manifest path: %v", err)
+	}
+	if _, err := fixture.driver.Stat(ctx, manifestPath); err != nil {
+		t.Errorf("expected referrer manifest to be preserved: %v", err)
+	}
+	if !blobExists(t, ctx, fixture.driver, signatureLayer.Digest) {
+		t.Error("expected referrer's layer blob to be preserved")
+	}
+}
+
+// TestMarkAndSweepDoesNotResumeWithoutResumeRunID checks that a
+// checkpoint left over under the same RunID as a new, unrelated run is
+// never loaded unless ResumeRunID explicitly asks for it. Without this,
+// a recurring RunID (e.g. "daily-gc") would silently resume from
+// whatever a previous, unrelated run happened to leave behind.
+func TestMarkAndSweepDoesNotResumeWithoutResumeRunID(t *testing.T) {
+	ctx := context.Background()
+	fixture := newGCTestFixture(t)
+
+	named, err := reference.WithName("repo")
+	if err != nil {
+		t.Fatalf("failed to parse repo name: %v", err)
+	}
+	repository, err := fixture.registry.Repository(ctx, named)
+	if err != nil {
+		t.Fatalf("failed to construct repository: %v", err)
+	}
+
+	tagged := pushManifest(t, ctx, repository, "latest")
+	untagged := pushManifest(t, ctx, repository, "")
+
+	checkpoint := inmemory.New()
+	const runID = "daily-gc"
+
+	// Simulate a leftover checkpoint from a stale, unrelated run that
+	// happened to reuse the same RunID: it claims every blob is
+	// already marked reachable, including the untagged manifest that
+	// this run should sweep.
+	if err := flushGCMarkBatch(ctx, GCOpts{Checkpoint: checkpoint, RunID: runID}, 0,
+		nil,
+		map[digest.Digest]struct{}{
+			untagged.manifestDigest: {},
+			untagged.layer.Digest:   {},
+			untagged.config.Digest:  {},
+		},
+		nil,
+	); err != nil {
+		t.Fatalf("failed to seed stale checkpoint: %v", err)
+	}
+
+	if err := MarkAndSweep(ctx, fixture.driver, fixture.registry, GCOpts{
+		RemoveUntagged: true,
+		Checkpoint:     checkpoint,
+		RunID:          runID,
+	}); err != nil {
+		t.Fatalf("MarkAndSweep failed: %v", err)
+	}
+
+	if blobExists(t, ctx, fixture.driver, untagged.layer.Digest) {
+		t.Error("expected untagged manifest's blob to be swept: a leftover checkpoint under the same RunID must not be resumed from without ResumeRunID")
+	}
+	if !blobExists(t, ctx, fixture.driver, tagged.layer.Digest) {
+		t.Error("expected tagged manifest's blob to survive")
+	}
+}
+
+// cancelAfterNRepos wraps a GCReporter and cancels once RepositoryStarted
+// has fired n times, simulating a crash partway through the mark phase.
+type cancelAfterNRepos struct {
+	GCReporter
+	n      int
+	count  int
+	cancel context.CancelFunc
+}
+
+func (r *cancelAfterNRepos) RepositoryStarted(repo string) {
+	r.GCReporter.RepositoryStarted(repo)
+	r.count++
+	if r.count == r.n {
+		r.cancel()
+	}
+}
+
+// TestMarkAndSweepResumeAfterCrash checks the literal resumable-GC
+// guarantee: interrupting a run partway through the mark phase, then
+// resuming it with ResumeRunID set to the interrupted run's RunID,
+// must produce the same final delete set as an uninterrupted, clean
+// run over the same repositories.
+func TestMarkAndSweepResumeAfterCrash(t *testing.T) {
+	ctx := context.Background()
+	const numRepos = 6
+
+	setup := func(t *testing.T, fixture *gcTestFixture) (kept, deleted []pushedManifest) {
+		for i := 0; i < numRepos; i++ {
+			named, err := reference.WithName(fmt.Sprintf("repo-%d", i))
+			if err != nil {
+				t.Fatalf("failed to parse repo name: %v", err)
+			}
+			repository, err := fixture.registry.Repository(ctx, named)
+			if err != nil {
+				t.Fatalf("failed to construct repository: %v", err)
+			}
+			if i%2 == 0 {
+				kept = append(kept, pushManifest(t, ctx, repository, "latest"))
+			} else {
+				deleted = append(deleted, pushManifest(t, ctx, repository, ""))
+			}
+		}
+		return kept, deleted
+	}
+
+	// The clean, uninterrupted run is the ground truth a crash-then-resume
+	// run must match. pushManifest derives blob content from the repo
+	// name and tag alone, so the digests line up across both fixtures.
+	clean := newGCTestFixture(t)
+	setup(t, clean)
+	if err := MarkAndSweep(ctx, clean.driver, clean.registry, GCOpts{RemoveUntagged: true}); err != nil {
+		t.Fatalf("clean run failed: %v", err)
+	}
+
+	resumed := newGCTestFixture(t)
+	kept, deleted := setup(t, resumed)
+
+	checkpoint := inmemory.New()
+	const runID = "gc-run"
+
+	crashCtx, cancel := context.WithCancel(ctx)
+	crashReporter := &cancelAfterNRepos{GCReporter: NewStdoutReporter(), n: numRepos / 2, cancel: cancel}
+	if err := MarkAndSweep(crashCtx, resumed.driver, resumed.registry, GCOpts{
+		RemoveUntagged:     true,
+		Checkpoint:         checkpoint,
+		RunID:              runID,
+		CheckpointInterval: 0,
+		Parallelism:        1,
+		Reporter:           crashReporter,
+	}); err == nil {
+		t.Fatal("expected the interrupted run to fail")
+	}
+
+	// The crash must have left real, resumable progress on disk.
+	crashCheckpoint, err := loadGCMarkCheckpoint(ctx, checkpoint, runID)
+	if err != nil {
+		t.Fatalf("failed to load mark checkpoint after crash: %v", err)
+	}
+	if crashCheckpoint.BatchCount == 0 || len(crashCheckpoint.CompletedRepositories) == 0 {
+		t.Fatal("expected the crashed run to have flushed at least one mark batch")
+	}
+
+	if err := MarkAndSweep(ctx, resumed.driver, resumed.registry, GCOpts{
+		RemoveUntagged: true,
+		Checkpoint:     checkpoint,
+		RunID:          runID,
+		ResumeRunID:    runID,
+	}); err != nil {
+		t.Fatalf("resumed run failed: %v", err)
+	}
+
+	for _, pm := range kept {
+		if !blobExists(t, ctx, clean.driver, pm.layer.Digest) || !blobExists(t, ctx, resumed.driver, pm.layer.Digest) {
+			t.Errorf("expected kept layer %s to survive both the clean and the crash-then-resumed run", pm.layer.Digest)
+		}
+	}
+	for _, pm := range deleted {
+		if blobExists(t, ctx, clean.driver, pm.layer.Digest) || blobExists(t, ctx, resumed.driver, pm.layer.Digest) {
+			t.Errorf("expected deleted layer %s to be swept by both the clean and the crash-then-resumed run", pm.layer.Digest)
+		}
+	}
+}
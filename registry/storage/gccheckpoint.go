@@ -0,0 +1,161 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/distribution/distribution/v3/registry/storage/driver"
+	"github.com/opencontainers/go-digest"
+)
+
+// gcMarkCheckpoint is the aggregated mark phase state for a run,
+// reconstructed by merging every batch flushed so far.
+type gcMarkCheckpoint struct {
+	// CompletedRepositories holds the repositories whose manifests have
+	// already been fully enumerated and folded into MarkSet.
+	CompletedRepositories []string
+	// MarkSet holds the accumulated set of reachable blob digests.
+	MarkSet []digest.Digest
+	// ManifestArr holds manifests already identified as eligible for
+	// deletion.
+	ManifestArr []ManifestDel
+	// BatchCount is the number of batch files merged to produce this
+	// checkpoint. A resuming run must continue numbering its own
+	// batches from here: batch files are addressed by runID and a
+	// sequence number alone, so starting back at 0 would overwrite a
+	// prior run's batch on the very first flush.
+	BatchCount int
+}
+
+// gcMarkBatch is one incrementally-flushed slice of mark phase
+// progress: the repositories completed, and the blobs/manifests
+// marked, since the previous flush. Persisting only this delta, rather
+// than re-serializing the whole accumulated run on every flush, keeps
+// checkpoint-write cost proportional to a single checkpoint interval
+// instead of the size of the run so far.
+type gcMarkBatch struct {
+	CompletedRepositories []string        `json:"completedRepositories"`
+	MarkSet               []digest.Digest `json:"markSet,omitempty"`
+	ManifestArr           []ManifestDel   `json:"manifestArr,omitempty"`
+}
+
+// gcSweepCheckpoint is the on-disk representation of in-progress sweep
+// phase state: the blobs already deleted by a prior, interrupted run.
+type gcSweepCheckpoint struct {
+	DeletedBlobs []digest.Digest `json:"deletedBlobs"`
+}
+
+func gcMarkBatchDir(runID string) string {
+	return fmt.Sprintf("/gc/checkpoints/%s/mark", runID)
+}
+
+func gcMarkBatchPath(runID string, seq int) string {
+	return fmt.Sprintf("%s/%020d.json", gcMarkBatchDir(runID), seq)
+}
+
+func gcSweepCheckpointPath(runID string) string {
+	return fmt.Sprintf("/gc/checkpoints/%s/sweep", runID)
+}
+
+// loadGCMarkCheckpoint reconstructs mark phase progress for runID by
+// reading and merging every batch a previous, interrupted run flushed.
+func loadGCMarkCheckpoint(ctx context.Context, checkpoint driver.StorageDriver, runID string) (*gcMarkCheckpoint, error) {
+	paths, err := checkpoint.List(ctx, gcMarkBatchDir(runID))
+	if err != nil {
+		if _, ok := err.(driver.PathNotFoundError); ok {
+			return &gcMarkCheckpoint{}, nil
+		}
+		return nil, err
+	}
+	sort.Strings(paths)
+
+	cp := &gcMarkCheckpoint{}
+	for _, path := range paths {
+		content, err := checkpoint.GetContent(ctx, path)
+		if err != nil {
+			return nil, err
+		}
+		var batch gcMarkBatch
+		if err := json.Unmarshal(content, &batch); err != nil {
+			return nil, fmt.Errorf("failed to decode mark checkpoint batch %s: %v", path, err)
+		}
+		cp.CompletedRepositories = append(cp.CompletedRepositories, batch.CompletedRepositories...)
+		cp.MarkSet = append(cp.MarkSet, batch.MarkSet...)
+		cp.ManifestArr = append(cp.ManifestArr, batch.ManifestArr...)
+	}
+	cp.BatchCount = len(paths)
+	return cp, nil
+}
+
+// saveGCMarkBatch persists one flush's worth of new mark phase progress
+// as its own batch file, instead of rewriting the whole accumulated
+// checkpoint.
+func saveGCMarkBatch(ctx context.Context, checkpoint driver.StorageDriver, runID string, seq int, batch *gcMarkBatch) error {
+	content, err := json.Marshal(batch)
+	if err != nil {
+		return fmt.Errorf("failed to encode mark checkpoint batch: %v", err)
+	}
+	return checkpoint.PutContent(ctx, gcMarkBatchPath(runID, seq), content)
+}
+
+func loadGCSweepCheckpoint(ctx context.Context, checkpoint driver.StorageDriver, runID string) (*gcSweepCheckpoint, error) {
+	content, err := checkpoint.GetContent(ctx, gcSweepCheckpointPath(runID))
+	if err != nil {
+		if _, ok := err.(driver.PathNotFoundError); ok {
+			return &gcSweepCheckpoint{}, nil
+		}
+		return nil, err
+	}
+
+	var cp gcSweepCheckpoint
+	if err := json.Unmarshal(content, &cp); err != nil {
+		return nil, fmt.Errorf("failed to decode sweep checkpoint: %v", err)
+	}
+	return &cp, nil
+}
+
+func saveGCSweepCheckpoint(ctx context.Context, checkpoint driver.StorageDriver, runID string, cp *gcSweepCheckpoint) error {
+	content, err := json.Marshal(cp)
+	if err != nil {
+		return fmt.Errorf("failed to encode sweep checkpoint: %v", err)
+	}
+	return checkpoint.PutContent(ctx, gcSweepCheckpointPath(runID), content)
+}
+
+// flushGCMarkBatch persists the mark phase progress made since the
+// previous flush — completedDelta, markSetDelta and manifestArrDelta —
+// as a new batch, so a crashed run can resume without this flush ever
+// having had to re-serialize progress that was already durable.
+func flushGCMarkBatch(ctx context.Context, opts GCOpts, seq int, completedDelta []string, markSetDelta map[digest.Digest]struct{}, manifestArrDelta []ManifestDel) error {
+	batch := &gcMarkBatch{
+		CompletedRepositories: completedDelta,
+		MarkSet:               make([]digest.Digest, 0, len(markSetDelta)),
+		ManifestArr:           manifestArrDelta,
+	}
+	for dgst := range markSetDelta {
+		batch.MarkSet = append(batch.MarkSet, dgst)
+	}
+	return saveGCMarkBatch(ctx, opts.Checkpoint, opts.RunID, seq, batch)
+}
+
+// flushGCSweepCheckpoint persists the current sweep phase progress so a
+// crashed run can resume from it.
+func flushGCSweepCheckpoint(ctx context.Context, opts GCOpts, deletedBlobs map[digest.Digest]struct{}) error {
+	cp := &gcSweepCheckpoint{
+		DeletedBlobs: make([]digest.Digest, 0, len(deletedBlobs)),
+	}
+	for dgst := range deletedBlobs {
+		cp.DeletedBlobs = append(cp.DeletedBlobs, dgst)
+	}
+	return saveGCSweepCheckpoint(ctx, opts.Checkpoint, opts.RunID, cp)
+}
+
+// deleteGCCheckpoints removes both checkpoints for runID. It is called
+// once a run completes successfully, and errors are not fatal: a
+// leftover checkpoint only costs a bit of storage, never correctness.
+func deleteGCCheckpoints(ctx context.Context, checkpoint driver.StorageDriver, runID string) {
+	_ = checkpoint.Delete(ctx, gcMarkBatchDir(runID))
+	_ = checkpoint.Delete(ctx, gcSweepCheckpointPath(runID))
+}
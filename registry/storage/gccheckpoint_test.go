@@ -0,0 +1,106 @@
+package storage
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/distribution/distribution/v3/registry/storage/driver/inmemory"
+	"github.com/opencontainers/go-digest"
+)
+
+// TestGCMarkCheckpointBatching checks that flushGCMarkBatch persists
+// only the delta passed to it, and that loadGCMarkCheckpoint
+// reconstructs the full accumulated state by merging every batch
+// written so far. The merged slices are sorted before comparison, so
+// the order of entries is not checked.
+func TestGCMarkCheckpointBatching(t *testing.T) {
+	ctx := context.Background()
+	checkpoint := inmemory.New()
+	opts := GCOpts{Checkpoint: checkpoint, RunID: "run-1"}
+
+	dgstA := digest.FromString("a")
+	dgstB := digest.FromString("b")
+	dgstC := digest.FromString("c")
+
+	if err := flushGCMarkBatch(ctx, opts, 0,
+		[]string{"repo-a"},
+		map[digest.Digest]struct{}{dgstA: {}},
+		[]ManifestDel{{Name: "repo-a", Digest: dgstA}},
+	); err != nil {
+		t.Fatalf("failed to flush batch 0: %v", err)
+	}
+	if err := flushGCMarkBatch(ctx, opts, 1,
+		[]string{"repo-b", "repo-c"},
+		map[digest.Digest]struct{}{dgstB: {}, dgstC: {}},
+		nil,
+	); err != nil {
+		t.Fatalf("failed to flush batch 1: %v", err)
+	}
+
+	cp, err := loadGCMarkCheckpoint(ctx, checkpoint, "run-1")
+	if err != nil {
+		t.Fatalf("failed to load mark checkpoint: %v", err)
+	}
+
+	gotRepos := append([]string(nil), cp.CompletedRepositories...)
+	sort.Strings(gotRepos)
+	wantRepos := []string{"repo-a", "repo-b", "repo-c"}
+	if !reflect.DeepEqual(gotRepos, wantRepos) {
+		t.Errorf("CompletedRepositories = %v, want %v", gotRepos, wantRepos)
+	}
+
+	gotDigests := append([]digest.Digest(nil), cp.MarkSet...)
+	sort.Slice(gotDigests, func(i, j int) bool { return gotDigests[i] < gotDigests[j] })
+	wantDigests := []digest.Digest{dgstA, dgstB, dgstC}
+	sort.Slice(wantDigests, func(i, j int) bool { return wantDigests[i] < wantDigests[j] })
+	if !reflect.DeepEqual(gotDigests, wantDigests) {
+		t.Errorf("MarkSet = %v, want %v", gotDigests, wantDigests)
+	}
+
+	if len(cp.ManifestArr) != 1 || cp.ManifestArr[0].Digest != dgstA {
+		t.Errorf("ManifestArr = %v, want a single entry for %s", cp.ManifestArr, dgstA)
+	}
+}
+
+// TestLoadGCMarkCheckpointMissing checks that loading a checkpoint for
+// a run that never flushed anything returns an empty, not an error,
+// result.
+func TestLoadGCMarkCheckpointMissing(t *testing.T) {
+	ctx := context.Background()
+	checkpoint := inmemory.New()
+
+	cp, err := loadGCMarkCheckpoint(ctx, checkpoint, "never-ran")
+	if err != nil {
+		t.Fatalf("loadGCMarkCheckpoint returned an error for a missing checkpoint: %v", err)
+	}
+	if len(cp.CompletedRepositories) != 0 || len(cp.MarkSet) != 0 || len(cp.ManifestArr) != 0 {
+		t.Errorf("expected an empty checkpoint, got %+v", cp)
+	}
+}
+
+// TestDeleteGCCheckpointsRemovesAllBatches checks that
+// deleteGCCheckpoints removes every mark batch written for a run, not
+// just a single consolidated file.
+func TestDeleteGCCheckpointsRemovesAllBatches(t *testing.T) {
+	ctx := context.Background()
+	checkpoint := inmemory.New()
+	opts := GCOpts{Checkpoint: checkpoint, RunID: "run-1"}
+
+	for seq := 0; seq < 3; seq++ {
+		if err := flushGCMarkBatch(ctx, opts, seq, []string{"repo"}, nil, nil); err != nil {
+			t.Fatalf("failed to flush batch %d: %v", seq, err)
+		}
+	}
+
+	deleteGCCheckpoints(ctx, checkpoint, "run-1")
+
+	cp, err := loadGCMarkCheckpoint(ctx, checkpoint, "run-1")
+	if err != nil {
+		t.Fatalf("loadGCMarkCheckpoint returned an error after deletion: %v", err)
+	}
+	if len(cp.CompletedRepositories) != 0 {
+		t.Errorf("expected no batches to remain after deleteGCCheckpoints, got %+v", cp)
+	}
+}
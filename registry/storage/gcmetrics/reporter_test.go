@@ -0,0 +1,62 @@
+package gcmetrics
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// TestReporter checks that Reporter's counters and gauges track the
+// GCReporter events MarkAndSweep fires as it runs.
+func TestReporter(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	r := NewReporter(reg)
+	dgst := digest.FromString("blob")
+
+	r.ManifestMarked("repo", dgst)
+	r.ManifestMarked("repo", dgst)
+	r.BlobMarked("repo", dgst)
+	r.ManifestEligibleForDeletion("repo", dgst)
+	r.BlobEligibleForDeletion(dgst)
+	r.BlobEligibleForDeletion(dgst)
+	r.Summary(5, 2, 1)
+	r.Err(errors.New("boom"))
+
+	if got, want := testutil.ToFloat64(r.manifestsMarked), 2.0; got != want {
+		t.Errorf("manifestsMarked = %v, want %v", got, want)
+	}
+	if got, want := testutil.ToFloat64(r.blobsMarked), 1.0; got != want {
+		t.Errorf("blobsMarked = %v, want %v", got, want)
+	}
+	if got, want := testutil.ToFloat64(r.manifestsEligible), 1.0; got != want {
+		t.Errorf("manifestsEligible = %v, want %v", got, want)
+	}
+	if got, want := testutil.ToFloat64(r.blobsEligible), 2.0; got != want {
+		t.Errorf("blobsEligible = %v, want %v", got, want)
+	}
+	if got, want := testutil.ToFloat64(r.lastRunBlobsMarked), 5.0; got != want {
+		t.Errorf("lastRunBlobsMarked = %v, want %v", got, want)
+	}
+	if got, want := testutil.ToFloat64(r.lastRunDeleted), 3.0; got != want {
+		t.Errorf("lastRunDeleted = %v, want %v", got, want)
+	}
+	if got, want := testutil.ToFloat64(r.lastRunErrors), 1.0; got != want {
+		t.Errorf("lastRunErrors = %v, want %v", got, want)
+	}
+}
+
+// TestReporterErrNil checks that Err(nil) -- no error aborted the run
+// -- does not increment the error counter.
+func TestReporterErrNil(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	r := NewReporter(reg)
+
+	r.Err(nil)
+
+	if got, want := testutil.ToFloat64(r.lastRunErrors), 0.0; got != want {
+		t.Errorf("lastRunErrors = %v, want %v", got, want)
+	}
+}
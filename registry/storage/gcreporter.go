@@ -0,0 +1,75 @@
+package storage
+
+import (
+	"github.com/opencontainers/go-digest"
+)
+
+// GCReporter receives structured events as MarkAndSweep progresses. It
+// lets embedders (a daemon, a k8s operator, a product built on top of
+// distribution) capture GC progress without scraping stdout.
+//
+// Implementations must be safe for concurrent use: the mark phase
+// dispatches per-repository work onto a worker pool and calls these
+// methods from multiple goroutines.
+type GCReporter interface {
+	// RepositoryStarted is called once the mark phase begins
+	// enumerating manifests for repo.
+	RepositoryStarted(repo string)
+	// ManifestMarked is called when a manifest is kept reachable.
+	ManifestMarked(repo string, dgst digest.Digest)
+	// BlobMarked is called when a blob referenced by a reachable
+	// manifest is kept reachable.
+	BlobMarked(repo string, dgst digest.Digest)
+	// ManifestEligibleForDeletion is called when an untagged manifest
+	// is added to the delete set.
+	ManifestEligibleForDeletion(repo string, dgst digest.Digest)
+	// BlobEligibleForDeletion is called when an unreferenced blob is
+	// added to the delete set.
+	BlobEligibleForDeletion(dgst digest.Digest)
+	// Summary is called once, after the mark phase and blob
+	// enumeration and before any blob is deleted, with the number of
+	// digests marked and of blobs and manifests eligible for deletion.
+	Summary(blobsMarked, blobsDeleted, manifestsDeleted int)
+	// Err is called with any error that aborts the run.
+	Err(err error)
+}
+
+// StdoutReporter is the default GCReporter, preserving the plain-text
+// progress output the CLI has always printed.
+type StdoutReporter struct{}
+
+// NewStdoutReporter returns the default GCReporter used when GCOpts.Reporter
+// is left unset.
+func NewStdoutReporter() *StdoutReporter {
+	return &StdoutReporter{}
+}
+
+func (*StdoutReporter) RepositoryStarted(repo string) {
+	emit(repo)
+}
+
+func (*StdoutReporter) ManifestMarked(repo string, dgst digest.Digest) {
+	emit("%s: marking manifest %s ", repo, dgst)
+}
+
+func (*StdoutReporter) BlobMarked(repo string, dgst digest.Digest) {
+	emit("%s: marking blob %s", repo, dgst)
+}
+
+func (*StdoutReporter) ManifestEligibleForDeletion(repo string, dgst digest.Digest) {
+	emit("manifest eligible for deletion: %s", dgst)
+}
+
+func (*StdoutReporter) BlobEligibleForDeletion(dgst digest.Digest) {
+	emit("blob eligible for deletion: %s", dgst)
+}
+
+func (*StdoutReporter) Summary(blobsMarked, blobsDeleted, manifestsDeleted int) {
+	emit("\n%d blobs marked, %d blobs and %d manifests eligible for deletion", blobsMarked, blobsDeleted, manifestsDeleted)
+}
+
+func (*StdoutReporter) Err(err error) {
+	if err != nil {
+		emit("gc: %v", err)
+	}
+}
@@ -0,0 +1,74 @@
+package storage
+
+import (
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// captureStdout redirects os.Stdout for the duration of fn and returns
+// everything written to it, so StdoutReporter's plain-text output can
+// be asserted on without changing emit's signature.
+func captureStdout(t *testing.T, fn func()) string {
+	t.Helper()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("failed to create pipe: %v", err)
+	}
+
+	orig := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = orig }()
+
+	fn()
+
+	if err := w.Close(); err != nil {
+		t.Fatalf("failed to close pipe writer: %v", err)
+	}
+	out, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("failed to read captured stdout: %v", err)
+	}
+	return string(out)
+}
+
+// TestStdoutReporter checks that StdoutReporter preserves the
+// plain-text progress output the CLI printed before GCReporter existed.
+func TestStdoutReporter(t *testing.T) {
+	reporter := NewStdoutReporter()
+	dgst := digest.FromString("blob")
+
+	tests := []struct {
+		name string
+		run  func()
+		want string
+	}{
+		{"RepositoryStarted", func() { reporter.RepositoryStarted("myrepo") }, "myrepo"},
+		{"ManifestMarked", func() { reporter.ManifestMarked("myrepo", dgst) }, "marking manifest " + dgst.String()},
+		{"BlobMarked", func() { reporter.BlobMarked("myrepo", dgst) }, "marking blob " + dgst.String()},
+		{"ManifestEligibleForDeletion", func() { reporter.ManifestEligibleForDeletion("myrepo", dgst) }, "manifest eligible for deletion: " + dgst.String()},
+		{"BlobEligibleForDeletion", func() { reporter.BlobEligibleForDeletion(dgst) }, "blob eligible for deletion: " + dgst.String()},
+		{"Summary", func() { reporter.Summary(1, 2, 3) }, "1 blobs marked, 2 blobs and 3 manifests eligible for deletion"},
+		{"Err", func() { reporter.Err(io.ErrUnexpectedEOF) }, "gc: " + io.ErrUnexpectedEOF.Error()},
+		{"Err/nil", func() { reporter.Err(nil) }, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := captureStdout(t, tt.run)
+			if tt.want == "" {
+				if out != "" {
+					t.Errorf("expected no output, got %q", out)
+				}
+				return
+			}
+			if !strings.Contains(out, tt.want) {
+				t.Errorf("output %q does not contain %q", out, tt.want)
+			}
+		})
+	}
+}